@@ -0,0 +1,88 @@
+// Package alloc provides pooled byte buffers so hot paths like per-connection
+// handshake serialization don't pay for a fresh allocation every time.
+package alloc
+
+import "sync"
+
+const (
+	// SmallBufferSize is the capacity of buffers handed out by SmallBuffer,
+	// sized for a VMess request/response header plus a small first chunk.
+	SmallBufferSize = 2 * 1024
+	// LargeBufferSize is the capacity of buffers handed out by LargeBuffer,
+	// sized for a full-size payload chunk.
+	LargeBufferSize = 16 * 1024
+	// UDPBufferSize is the capacity of buffers handed out by UDPBuffer,
+	// sized for a full UDP datagram (the IPv4 max payload is 65507 bytes).
+	UDPBufferSize = 64 * 1024
+)
+
+var (
+	smallPool = &sync.Pool{New: func() interface{} { return &Buffer{Value: make([]byte, 0, SmallBufferSize)} }}
+	largePool = &sync.Pool{New: func() interface{} { return &Buffer{Value: make([]byte, 0, LargeBufferSize)} }}
+	udpPool   = &sync.Pool{New: func() interface{} { return &Buffer{Value: make([]byte, 0, UDPBufferSize)} }}
+)
+
+// Buffer is a pooled, reusable byte slice. Call Release when done with it so
+// the underlying array can be handed to the next caller.
+type Buffer struct {
+	Value []byte
+	pool  *sync.Pool
+}
+
+// SmallBuffer returns a Buffer with at least SmallBufferSize of capacity.
+func SmallBuffer() *Buffer {
+	buffer := smallPool.Get().(*Buffer)
+	buffer.pool = smallPool
+	return buffer
+}
+
+// LargeBuffer returns a Buffer with at least LargeBufferSize of capacity.
+func LargeBuffer() *Buffer {
+	buffer := largePool.Get().(*Buffer)
+	buffer.pool = largePool
+	return buffer
+}
+
+// UDPBuffer returns a Buffer with at least UDPBufferSize of capacity, sized
+// to hold one UDP datagram.
+func UDPBuffer() *Buffer {
+	buffer := udpPool.Get().(*Buffer)
+	buffer.pool = udpPool
+	return buffer
+}
+
+// Len returns the number of bytes currently held in this buffer.
+func (b *Buffer) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.Value)
+}
+
+// Clear resets the buffer to zero length without releasing its capacity.
+func (b *Buffer) Clear() *Buffer {
+	b.Value = b.Value[:0]
+	return b
+}
+
+// Append appends data to this buffer, growing it if necessary.
+func (b *Buffer) Append(data []byte) *Buffer {
+	b.Value = append(b.Value, data...)
+	return b
+}
+
+// AppendBytes appends individual bytes to this buffer.
+func (b *Buffer) AppendBytes(bytes ...byte) *Buffer {
+	b.Value = append(b.Value, bytes...)
+	return b
+}
+
+// Release returns this buffer to its pool. The buffer must not be used
+// again afterwards.
+func (b *Buffer) Release() {
+	if b == nil || b.pool == nil {
+		return
+	}
+	b.Clear()
+	b.pool.Put(b)
+}
@@ -0,0 +1,160 @@
+// Package io frames VMess payloads on top of the plain AES stream used by
+// the request/response bodies.
+package io
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/fnv"
+	"io"
+
+	"github.com/v2ray/v2ray-core/common/alloc"
+)
+
+var (
+	ErrorCorruptedChunk = errors.New("vmess: chunk checksum mismatch, connection possibly hijacked")
+	// ErrorChunkTooLarge is returned by Write when payload is longer than
+	// chunkMaxPayloadLen.
+	ErrorChunkTooLarge = errors.New("vmess: chunk payload exceeds the maximum chunk size")
+)
+
+const (
+	chunkHeaderLen = 2 + 4 // uint16 length + uint32 fnv1a(payload)
+
+	// chunkTerminatorLength is a length value reserved to mark a clean end
+	// of stream (written by Close). It can never be a real payload length,
+	// so it doesn't collide with a legitimate zero-length chunk the way a
+	// bare zero-length header once did.
+	chunkTerminatorLength = 0xFFFF
+	// chunkMaxPayloadLen is the largest payload a single Write can frame,
+	// one less than chunkTerminatorLength so the two can't be confused.
+	chunkMaxPayloadLen = chunkTerminatorLength - 1
+)
+
+// ChunkWriter frames each Write call as [uint16 length][uint32 fnv1a][payload]
+// on top of the underlying (already-encrypting) writer. Close writes a
+// reserved terminator length that terminates the stream without colliding
+// with a legitimate zero-length payload.
+type ChunkWriter struct {
+	writer io.Writer
+}
+
+func NewChunkWriter(writer io.Writer) *ChunkWriter {
+	return &ChunkWriter{writer: writer}
+}
+
+func (w *ChunkWriter) Write(payload []byte) (int, error) {
+	if len(payload) > chunkMaxPayloadLen {
+		return 0, ErrorChunkTooLarge
+	}
+
+	headerBuf := alloc.SmallBuffer()
+	defer headerBuf.Release()
+	header := headerBuf.Value[:chunkHeaderLen]
+	binary.BigEndian.PutUint16(header[0:2], uint16(len(payload)))
+	binary.BigEndian.PutUint32(header[2:6], fnvSum(payload))
+
+	if _, err := w.writer.Write(header); err != nil {
+		return 0, err
+	}
+	if len(payload) == 0 {
+		return 0, nil
+	}
+	return w.writer.Write(payload)
+}
+
+// Close writes the reserved terminator chunk that marks a clean end of
+// stream. Unlike a zero-length Write, it can't be mistaken for real data.
+func (w *ChunkWriter) Close() error {
+	headerBuf := alloc.SmallBuffer()
+	defer headerBuf.Release()
+	header := headerBuf.Value[:chunkHeaderLen]
+	binary.BigEndian.PutUint16(header[0:2], chunkTerminatorLength)
+	binary.BigEndian.PutUint32(header[2:6], 0)
+	_, err := w.writer.Write(header)
+	return err
+}
+
+// ChunkReader reverses ChunkWriter, verifying each chunk's checksum and
+// surfacing io.EOF on the reserved terminator chunk.
+type ChunkReader struct {
+	reader     io.Reader
+	pendingBuf *alloc.Buffer
+	pending    []byte
+}
+
+func NewChunkReader(reader io.Reader) *ChunkReader {
+	return &ChunkReader{reader: reader}
+}
+
+func (r *ChunkReader) Read(b []byte) (int, error) {
+	if len(r.pending) == 0 {
+		r.releasePending()
+		buf, err := r.readChunk()
+		if err != nil {
+			return 0, err
+		}
+		r.pendingBuf = buf
+		r.pending = buf.Value
+	}
+
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	if len(r.pending) == 0 {
+		r.releasePending()
+	}
+	return n, nil
+}
+
+func (r *ChunkReader) releasePending() {
+	if r.pendingBuf != nil {
+		r.pendingBuf.Release()
+		r.pendingBuf = nil
+	}
+}
+
+// readChunk reads one chunk's worth of payload into a pooled buffer, which
+// the caller must Release once it has copied the data out. The returned
+// buffer's backing array may be larger than LargeBufferSize when a chunk
+// exceeds the pool's tier.
+func (r *ChunkReader) readChunk() (*alloc.Buffer, error) {
+	headerBuf := alloc.SmallBuffer()
+	defer headerBuf.Release()
+	header := headerBuf.Value[:chunkHeaderLen]
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint16(header[0:2])
+	if length == chunkTerminatorLength {
+		return nil, io.EOF
+	}
+	expectedSum := binary.BigEndian.Uint32(header[2:6])
+
+	payloadBuf := alloc.LargeBuffer()
+	if int(length) > cap(payloadBuf.Value) {
+		payloadBuf.Value = make([]byte, 0, length)
+	}
+	payloadBuf.Value = payloadBuf.Value[:length]
+
+	if _, err := io.ReadFull(r.reader, payloadBuf.Value); err != nil {
+		payloadBuf.Release()
+		return nil, err
+	}
+	if fnvSum(payloadBuf.Value) != expectedSum {
+		payloadBuf.Release()
+		return nil, ErrorCorruptedChunk
+	}
+	return payloadBuf, nil
+}
+
+func fnvSum(payload []byte) uint32 {
+	fnvHash := newFnv32a()
+	fnvHash.Write(payload)
+	return fnvHash.Sum32()
+}
+
+func newFnv32a() hash.Hash32 {
+	return fnv.New32a()
+}
@@ -0,0 +1,63 @@
+package io
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestChunkWriterReaderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewChunkWriter(&buf)
+
+	payloads := [][]byte{[]byte("hello"), []byte("world"), {}}
+	for _, p := range payloads {
+		if _, err := writer.Write(p); err != nil {
+			t.Fatalf("Write(%q) returned error: %v", p, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	reader := NewChunkReader(&buf)
+	for _, want := range payloads {
+		got := make([]byte, len(want)+1)
+		n, err := reader.Read(got)
+		if err != nil {
+			t.Fatalf("Read returned error: %v", err)
+		}
+		if !bytes.Equal(got[:n], want) {
+			t.Errorf("Read = %q, want %q", got[:n], want)
+		}
+	}
+
+	if _, err := reader.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after terminator = %v, want io.EOF", err)
+	}
+}
+
+func TestChunkWriterRejectsOversizedPayload(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewChunkWriter(&buf)
+
+	if _, err := writer.Write(make([]byte, chunkMaxPayloadLen+1)); err != ErrorChunkTooLarge {
+		t.Errorf("Write of an oversized payload = %v, want ErrorChunkTooLarge", err)
+	}
+}
+
+func TestChunkReaderDetectsCorruption(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewChunkWriter(&buf)
+	if _, err := writer.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	corrupted := buf.Bytes()
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	reader := NewChunkReader(bytes.NewReader(corrupted))
+	if _, err := reader.Read(make([]byte, 5)); err != ErrorCorruptedChunk {
+		t.Errorf("Read of corrupted chunk = %v, want ErrorCorruptedChunk", err)
+	}
+}
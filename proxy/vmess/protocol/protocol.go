@@ -0,0 +1,34 @@
+// Package protocol implements the VMess request/response wire format.
+package protocol
+
+// Version is the VMess protocol version this package speaks.
+const Version byte = 1
+
+// RequestCommand indicates the kind of tunnel a VMessRequest is asking for.
+type RequestCommand byte
+
+const (
+	CmdTCP RequestCommand = 0x01
+	CmdUDP RequestCommand = 0x02
+)
+
+// RequestOption is a bitmask of optional behaviors negotiated in a
+// VMessRequest.
+type RequestOption byte
+
+const (
+	// OptionChunkStream indicates the request/response payload is framed
+	// as a sequence of length-prefixed, checksummed chunks, rather than a
+	// raw byte stream.
+	OptionChunkStream RequestOption = 0x01
+)
+
+// Has returns true if this option set contains flag.
+func (o RequestOption) Has(flag RequestOption) bool {
+	return o&flag == flag
+}
+
+// Set turns on flag in this option set.
+func (o *RequestOption) Set(flag RequestOption) {
+	*o |= flag
+}
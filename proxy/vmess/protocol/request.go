@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+
+	v2net "github.com/v2ray/v2ray-core/common/net"
+	"github.com/v2ray/v2ray-core/proxy/vmess/protocol/user"
+)
+
+var (
+	ErrorUnsupportedAddressType = errors.New("vmess: unsupported address type")
+)
+
+// VMessRequest is a VMess request header, as sent by a client to a VNext
+// server.
+type VMessRequest struct {
+	Version    byte
+	UserId     user.ID
+	RequestIV  [16]byte
+	RequestKey [16]byte
+	// ResponseHeader holds V, a single byte chosen by the client. The
+	// server must not echo V back; it responds with ResponseHeaderToken(V,
+	// RequestKey) so a passive observer of the request can't predict it.
+	ResponseHeader [1]byte
+	Command        RequestCommand
+	Option         RequestOption
+	Address        v2net.Address
+}
+
+// ToBytes serializes this request into buffer, appending to whatever is
+// already there. session authenticates UserId against the current time, and
+// randomRangeInt64 is used to size the trailing padding.
+func (request *VMessRequest) ToBytes(session *ClientSession, randomRangeInt64 func(min, max int64) int64, buffer []byte) ([]byte, error) {
+	buffer = append(buffer, session.Auth(request.UserId)...)
+
+	buffer = append(buffer, request.Version)
+	buffer = append(buffer, request.RequestIV[:]...)
+	buffer = append(buffer, request.RequestKey[:]...)
+	buffer = append(buffer, request.ResponseHeader[:]...)
+	buffer = append(buffer, byte(request.Option))
+	buffer = append(buffer, byte(request.Command))
+
+	port := int(request.Address.Port())
+	buffer = append(buffer, byte(port>>8), byte(port))
+
+	ip := request.Address.IP()
+	switch len(ip) {
+	case net.IPv4len:
+		buffer = append(buffer, 0x01)
+		buffer = append(buffer, ip...)
+	case net.IPv6len:
+		buffer = append(buffer, 0x03)
+		buffer = append(buffer, ip...)
+	default:
+		return nil, ErrorUnsupportedAddressType
+	}
+
+	paddingLen := randomRangeInt64(0, 16)
+	padding := make([]byte, paddingLen)
+	rand.Read(padding)
+	buffer = append(buffer, padding...)
+
+	return buffer, nil
+}
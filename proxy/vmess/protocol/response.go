@@ -0,0 +1,16 @@
+package protocol
+
+import "crypto/md5"
+
+// VMessResponse is the single-byte header a VNext server sends back to the
+// client to confirm the request was understood and not tampered with in
+// transit. Unlike the request's V, it is never sent verbatim: it is derived
+// from V, so a passive observer who only sees the request can't predict it.
+type VMessResponse [1]byte
+
+// ResponseHeaderToken derives the byte a server should respond with for a
+// client-chosen v and the request's RequestKey.
+func ResponseHeaderToken(v byte, requestKey []byte) byte {
+	sum := md5.Sum(append([]byte{v}, requestKey...))
+	return sum[0]
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"time"
+
+	"github.com/v2ray/v2ray-core/proxy/vmess/protocol/user"
+)
+
+const (
+	// DefaultTimeSkew is how far a client is allowed to jitter the
+	// timestamp it signs its auth header with, in either direction.
+	DefaultTimeSkew = 30 * time.Second
+)
+
+// ClientSession builds the 16-byte auth header a client sends ahead of its
+// AES-encrypted request body, binding it to the current time within
+// timeSkew so the server can bound how stale or futuristic a request may be.
+type ClientSession struct {
+	idHash user.IDHash
+}
+
+// NewClientSession builds a ClientSession using hashCreator (typically
+// user.HMACHash{}) and the given time-skew window. timeSkew <= 0 falls back
+// to DefaultTimeSkew.
+func NewClientSession(hashCreator user.IDHashCreator, timeSkew time.Duration) *ClientSession {
+	if timeSkew <= 0 {
+		timeSkew = DefaultTimeSkew
+	}
+	return &ClientSession{idHash: user.NewTimeHashWithSkew(hashCreator, timeSkew)}
+}
+
+// Auth returns the 16-byte auth header for id, to be written before the
+// AES-encrypted request body.
+func (s *ClientSession) Auth(id user.ID) []byte {
+	return s.idHash(id.Bytes()).Sum(nil)
+}
+
+// KNOWN GAP: there is no server-side counterpart to ClientSession in this
+// tree. The anti-replay cache originally requested alongside the timestamp
+// handshake (a ServerSession rejecting a duplicate Auth() within a replay
+// window, sized via inbound config) is NOT implemented here and shipped in
+// no commit of this series — this package only has a VMess outbound
+// handler, so there is no inbound call site to build it against. Treat the
+// anti-replay half of that request as un-started, not merely unwired: it
+// needs its own follow-up once a VMess inbound handler exists in this tree.
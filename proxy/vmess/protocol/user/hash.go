@@ -0,0 +1,76 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"hash"
+	mrand "math/rand"
+	"time"
+)
+
+// IDHash creates a keyed hash.Hash used to authenticate a VMess ID on the
+// wire. The key is the raw bytes of a user's ID.
+type IDHash func(key []byte) hash.Hash
+
+// IDHashCreator creates the underlying keyed hash.Hash that an IDHash wraps.
+type IDHashCreator interface {
+	Create(key []byte) hash.Hash
+}
+
+// HMACHash creates HMAC-MD5 hashes keyed by a user ID.
+type HMACHash struct{}
+
+func (h HMACHash) Create(key []byte) hash.Hash {
+	return hmac.New(md5.New, key)
+}
+
+// NewTimeHash wraps an IDHashCreator so the resulting hash.Hash has the
+// current time already written into it. This is used to derive the
+// per-request auth header, binding it to the moment the request was built.
+func NewTimeHash(creator IDHashCreator) IDHash {
+	return NewTimeHashWithSkew(creator, 0)
+}
+
+// NewTimeHashWithSkew is like NewTimeHash, but the timestamp written into
+// the hash is randomly offset by up to skew in either direction, so servers
+// watching for replay can't fingerprint clients by their clock precision.
+// skew <= 0 disables the offset.
+func NewTimeHashWithSkew(creator IDHashCreator, skew time.Duration) IDHash {
+	return func(key []byte) hash.Hash {
+		hasher := creator.Create(key)
+		hasher.Write(timeBytes(skewedNow(skew)))
+		return hasher
+	}
+}
+
+func skewedNow(skew time.Duration) int64 {
+	now := NowTime()
+	if skew <= 0 {
+		return now
+	}
+	skewSeconds := int64(skew / time.Second)
+	if skewSeconds <= 0 {
+		return now
+	}
+	return now + GenerateRandomInt64InRange(-skewSeconds, skewSeconds+1)
+}
+
+func timeBytes(t int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t))
+	return b
+}
+
+// NowTime returns the current Unix timestamp, in seconds.
+func NowTime() int64 {
+	return time.Now().Unix()
+}
+
+// GenerateRandomInt64InRange returns a pseudo-random int64 in [min, max).
+func GenerateRandomInt64InRange(min, max int64) int64 {
+	if max <= min {
+		return min
+	}
+	return min + mrand.Int63n(max-min)
+}
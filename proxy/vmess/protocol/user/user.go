@@ -0,0 +1,15 @@
+package user
+
+// ID represents the identifier of a VMess account, carried on the wire as
+// a 16-byte UUID.
+type ID [16]byte
+
+// Bytes returns the raw bytes of this ID.
+func (id ID) Bytes() []byte {
+	return id[:]
+}
+
+// User is a VMess account known to either the client or the server.
+type User struct {
+	Id ID
+}
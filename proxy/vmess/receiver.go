@@ -0,0 +1,161 @@
+package vmess
+
+import (
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	v2net "github.com/v2ray/v2ray-core/common/net"
+	"github.com/v2ray/v2ray-core/proxy/vmess/protocol/user"
+)
+
+const (
+	// DefaultReceiverFailureThreshold is how many consecutive dial or
+	// handshake failures a receiver tolerates before it is marked down.
+	DefaultReceiverFailureThreshold = 3
+	// DefaultReceiverCooldown is how long a receiver stays down once it
+	// has tripped the failure threshold.
+	DefaultReceiverCooldown = 5 * time.Minute
+)
+
+// receiverState tracks the health of a single VNext server.
+type receiverState struct {
+	server              VNextServer
+	weight              int
+	consecutiveFailures int
+	downUntil           time.Time
+}
+
+// ReceiverManager selects a VNext server (and one of its users) for each new
+// connection, weighted by the server's configured weight, and keeps
+// recently-failing servers out of rotation for a cooldown period.
+type ReceiverManager struct {
+	sync.Mutex
+	receivers        []*receiverState
+	totalWeight      int
+	failureThreshold int
+	cooldown         time.Duration
+}
+
+// NewReceiverManager builds a manager over servers. A server with Weight <= 0
+// is treated as weight 1.
+func NewReceiverManager(servers []VNextServer, failureThreshold int, cooldown time.Duration) *ReceiverManager {
+	if failureThreshold <= 0 {
+		failureThreshold = DefaultReceiverFailureThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultReceiverCooldown
+	}
+
+	receivers := make([]*receiverState, 0, len(servers))
+	totalWeight := 0
+	for _, server := range servers {
+		weight := server.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		receivers = append(receivers, &receiverState{server: server, weight: weight})
+		totalWeight += weight
+	}
+
+	return &ReceiverManager{
+		receivers:        receivers,
+		totalWeight:      totalWeight,
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+	}
+}
+
+// PickReceiver returns a weighted-random VNext server and one of its users.
+// Servers marked down are skipped, unless every server is currently down, in
+// which case the whole pool is considered again to avoid a hard outage.
+func (m *ReceiverManager) PickReceiver() (v2net.Destination, user.User) {
+	m.Lock()
+	defer m.Unlock()
+
+	if len(m.receivers) == 0 {
+		panic("VMessOut: Zero vNext is configured.")
+	}
+
+	now := time.Now()
+	receiver := m.pickWeighted(now, true)
+	if receiver == nil {
+		receiver = m.pickWeighted(now, false)
+	}
+
+	vNextUsers := receiver.server.Users
+	if len(vNextUsers) == 0 {
+		panic("VMessOut: Zero User account.")
+	}
+	vNextUserIndex := 0
+	if len(vNextUsers) > 1 {
+		vNextUserIndex = mrand.Intn(len(vNextUsers))
+	}
+	return receiver.server.Destination, vNextUsers[vNextUserIndex]
+}
+
+// pickWeighted does a single weighted-random pass. When upOnly is true,
+// receivers currently in their cooldown window are excluded.
+func (m *ReceiverManager) pickWeighted(now time.Time, upOnly bool) *receiverState {
+	weight := 0
+	for _, r := range m.receivers {
+		if upOnly && r.downUntil.After(now) {
+			continue
+		}
+		weight += r.weight
+	}
+	if weight == 0 {
+		return nil
+	}
+
+	target := mrand.Intn(weight)
+	for _, r := range m.receivers {
+		if upOnly && r.downUntil.After(now) {
+			continue
+		}
+		if target < r.weight {
+			return r
+		}
+		target -= r.weight
+	}
+	return nil
+}
+
+// ReportFailure records a dial or handshake failure against dest. Once
+// consecutive failures reach the configured threshold, dest is taken out of
+// rotation for the cooldown period.
+func (m *ReceiverManager) ReportFailure(dest v2net.Destination) {
+	m.Lock()
+	defer m.Unlock()
+
+	r := m.find(dest)
+	if r == nil {
+		return
+	}
+	r.consecutiveFailures++
+	if r.consecutiveFailures >= m.failureThreshold {
+		r.downUntil = time.Now().Add(m.cooldown)
+	}
+}
+
+// ReportSuccess clears dest's failure count, ending any cooldown early.
+func (m *ReceiverManager) ReportSuccess(dest v2net.Destination) {
+	m.Lock()
+	defer m.Unlock()
+
+	r := m.find(dest)
+	if r == nil {
+		return
+	}
+	r.consecutiveFailures = 0
+	r.downUntil = time.Time{}
+}
+
+func (m *ReceiverManager) find(dest v2net.Destination) *receiverState {
+	for _, r := range m.receivers {
+		if r.server.Destination.String() == dest.String() {
+			return r
+		}
+	}
+	return nil
+}
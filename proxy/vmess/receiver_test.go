@@ -0,0 +1,102 @@
+package vmess
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	v2net "github.com/v2ray/v2ray-core/common/net"
+	"github.com/v2ray/v2ray-core/proxy/vmess/protocol/user"
+)
+
+func testDestination(port int) v2net.Destination {
+	return v2net.TCPDestination(v2net.IPAddress(net.ParseIP("127.0.0.1")), v2net.Port(port))
+}
+
+func testServer(port, weight int) VNextServer {
+	return VNextServer{
+		Destination: testDestination(port),
+		Users:       []user.User{{}},
+		Weight:      weight,
+	}
+}
+
+func TestPickWeightedDistribution(t *testing.T) {
+	manager := NewReceiverManager([]VNextServer{testServer(1, 1), testServer(2, 3)}, 0, 0)
+
+	counts := map[string]int{}
+	const trials = 10000
+	for i := 0; i < trials; i++ {
+		r := manager.pickWeighted(time.Now(), false)
+		if r == nil {
+			t.Fatal("pickWeighted returned nil with no receiver down")
+		}
+		counts[r.server.Destination.String()]++
+	}
+
+	ratio := float64(counts[testDestination(2).String()]) / float64(trials)
+	if ratio < 0.65 || ratio > 0.85 {
+		t.Errorf("weight-3 receiver picked %.2f of the time, want ~0.75", ratio)
+	}
+}
+
+func TestPickWeightedSkipsDownReceiver(t *testing.T) {
+	manager := NewReceiverManager([]VNextServer{testServer(1, 1), testServer(2, 1)}, 0, 0)
+	now := time.Now()
+	manager.receivers[0].downUntil = now.Add(time.Minute)
+
+	for i := 0; i < 100; i++ {
+		r := manager.pickWeighted(now, true)
+		if r == nil {
+			t.Fatal("pickWeighted returned nil with one receiver still up")
+		}
+		if r.server.Destination.String() != testDestination(2).String() {
+			t.Fatalf("pickWeighted chose the down receiver")
+		}
+	}
+}
+
+func TestPickWeightedAllDownFallsBackToWholePool(t *testing.T) {
+	manager := NewReceiverManager([]VNextServer{testServer(1, 1), testServer(2, 1)}, 0, 0)
+	now := time.Now()
+	for _, r := range manager.receivers {
+		r.downUntil = now.Add(time.Minute)
+	}
+
+	if r := manager.pickWeighted(now, true); r != nil {
+		t.Fatal("pickWeighted(upOnly=true) should return nil when every receiver is down")
+	}
+	if r := manager.pickWeighted(now, false); r == nil {
+		t.Fatal("pickWeighted(upOnly=false) should still return a receiver")
+	}
+}
+
+func TestReportFailureTripsCooldownAfterThreshold(t *testing.T) {
+	manager := NewReceiverManager([]VNextServer{testServer(1, 1)}, 2, time.Minute)
+	dest := testDestination(1)
+
+	manager.ReportFailure(dest)
+	if manager.receivers[0].downUntil.After(time.Now()) {
+		t.Fatal("receiver marked down before reaching the failure threshold")
+	}
+
+	manager.ReportFailure(dest)
+	if !manager.receivers[0].downUntil.After(time.Now()) {
+		t.Fatal("receiver not marked down after reaching the failure threshold")
+	}
+}
+
+func TestReportSuccessClearsCooldown(t *testing.T) {
+	manager := NewReceiverManager([]VNextServer{testServer(1, 1)}, 1, time.Minute)
+	dest := testDestination(1)
+
+	manager.ReportFailure(dest)
+	if !manager.receivers[0].downUntil.After(time.Now()) {
+		t.Fatal("receiver should be down after one failure at threshold 1")
+	}
+
+	manager.ReportSuccess(dest)
+	if manager.receivers[0].consecutiveFailures != 0 || manager.receivers[0].downUntil.After(time.Now()) {
+		t.Fatal("ReportSuccess should clear failure count and cooldown")
+	}
+}
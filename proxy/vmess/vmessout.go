@@ -1,94 +1,100 @@
 package vmess
 
 import (
-	"bytes"
 	"crypto/md5"
 	"crypto/rand"
-	mrand "math/rand"
+	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/v2ray/v2ray-core"
+	"github.com/v2ray/v2ray-core/common/alloc"
 	v2io "github.com/v2ray/v2ray-core/common/io"
 	"github.com/v2ray/v2ray-core/common/log"
 	v2net "github.com/v2ray/v2ray-core/common/net"
+	vmessio "github.com/v2ray/v2ray-core/proxy/vmess/io"
 	"github.com/v2ray/v2ray-core/proxy/vmess/protocol"
 	"github.com/v2ray/v2ray-core/proxy/vmess/protocol/user"
 )
 
 const (
 	InfoTimeNotSync = "Please check the User ID in your vmess configuration, and make sure the time on your local and remote server are in sync."
+
+	// udpSessionTimeout bounds how long either direction of a tunneled UDP
+	// session may go without traffic before the session is closed, so idle
+	// datagrams don't pin goroutines and sockets indefinitely.
+	udpSessionTimeout = 120 * time.Second
 )
 
 // VNext is the next Point server in the connection chain.
 type VNextServer struct {
 	Destination v2net.Destination // Address of VNext server
 	Users       []user.User       // User accounts for accessing VNext.
+	Weight      int               // Relative weight for selection, treated as 1 if <= 0.
 }
 
 type VMessOutboundHandler struct {
-	vPoint       *core.Point
-	packet       v2net.Packet
-	vNextList    []VNextServer
-	vNextListUDP []VNextServer
+	vPoint            *core.Point
+	packet            v2net.Packet
+	receivers         *ReceiverManager
+	receiversUDP      *ReceiverManager
+	enableChunkStream bool
+	timeSkew          time.Duration
 }
 
-func NewVMessOutboundHandler(vp *core.Point, vNextList, vNextListUDP []VNextServer, firstPacket v2net.Packet) *VMessOutboundHandler {
+func NewVMessOutboundHandler(vp *core.Point, receivers, receiversUDP *ReceiverManager, enableChunkStream bool, timeSkew time.Duration, firstPacket v2net.Packet) *VMessOutboundHandler {
 	return &VMessOutboundHandler{
-		vPoint:    vp,
-		packet:    firstPacket,
-		vNextList: vNextList,
-	}
-}
-
-func pickVNext(serverList []VNextServer) (v2net.Destination, user.User) {
-	vNextLen := len(serverList)
-	if vNextLen == 0 {
-		panic("VMessOut: Zero vNext is configured.")
-	}
-	vNextIndex := 0
-	if vNextLen > 1 {
-		vNextIndex = mrand.Intn(vNextLen)
-	}
-
-	vNext := serverList[vNextIndex]
-	vNextUserLen := len(vNext.Users)
-	if vNextUserLen == 0 {
-		panic("VMessOut: Zero User account.")
-	}
-	vNextUserIndex := 0
-	if vNextUserLen > 1 {
-		vNextUserIndex = mrand.Intn(vNextUserLen)
+		vPoint:            vp,
+		packet:            firstPacket,
+		receivers:         receivers,
+		receiversUDP:      receiversUDP,
+		enableChunkStream: enableChunkStream,
+		timeSkew:          timeSkew,
 	}
-	vNextUser := vNext.Users[vNextUserIndex]
-	return vNext.Destination, vNextUser
 }
 
 func (handler *VMessOutboundHandler) Start(ray core.OutboundRay) error {
-	vNextAddress, vNextUser := pickVNext(handler.vNextList)
+	isUDP := handler.packet.Destination().IsUDP()
 
+	receivers := handler.receivers
 	command := protocol.CmdTCP
-	if handler.packet.Destination().IsUDP() {
+	if isUDP {
+		receivers = handler.receiversUDP
 		command = protocol.CmdUDP
 	}
+	vNextAddress, vNextUser := receivers.PickReceiver()
+
 	request := &protocol.VMessRequest{
 		Version: protocol.Version,
 		UserId:  vNextUser.Id,
 		Command: command,
 		Address: handler.packet.Destination().Address(),
 	}
-	rand.Read(request.RequestIV[:])
-	rand.Read(request.RequestKey[:])
-	rand.Read(request.ResponseHeader[:])
+	if command == protocol.CmdUDP || handler.enableChunkStream {
+		request.Option.Set(protocol.OptionChunkStream)
+	}
+	randomBytes := alloc.SmallBuffer()
+	randomBytes.Value = randomBytes.Value[:16+16+len(request.ResponseHeader)]
+	rand.Read(randomBytes.Value)
+	copy(request.RequestIV[:], randomBytes.Value[0:16])
+	copy(request.RequestKey[:], randomBytes.Value[16:32])
+	copy(request.ResponseHeader[:], randomBytes.Value[32:])
+	randomBytes.Release()
 
-	go startCommunicate(request, vNextAddress, ray, handler.packet)
+	if isUDP {
+		go startUDPCommunicate(request, vNextAddress, receivers, handler.timeSkew, ray, handler.packet)
+	} else {
+		go startCommunicate(request, vNextAddress, receivers, handler.timeSkew, ray, handler.packet)
+	}
 	return nil
 }
 
-func startCommunicate(request *protocol.VMessRequest, dest v2net.Destination, ray core.OutboundRay, firstPacket v2net.Packet) error {
+func startCommunicate(request *protocol.VMessRequest, dest v2net.Destination, receivers *ReceiverManager, timeSkew time.Duration, ray core.OutboundRay, firstPacket v2net.Packet) error {
 	conn, err := net.DialTCP(dest.Network(), nil, &net.TCPAddr{dest.Address().IP(), int(dest.Address().Port()), ""})
 	if err != nil {
 		log.Error("Failed to open tcp (%s): %v", dest.String(), err)
+		receivers.ReportFailure(dest)
 		if ray != nil {
 			close(ray.OutboundOutput())
 		}
@@ -104,8 +110,8 @@ func startCommunicate(request *protocol.VMessRequest, dest v2net.Destination, ra
 	requestFinish.Lock()
 	responseFinish.Lock()
 
-	go handleRequest(conn, request, firstPacket, input, &requestFinish)
-	go handleResponse(conn, request, output, &responseFinish)
+	go handleRequest(conn, request, timeSkew, firstPacket, input, &requestFinish)
+	go handleResponse(conn, request, dest, receivers, output, &responseFinish)
 
 	requestFinish.Lock()
 	conn.CloseWrite()
@@ -113,7 +119,138 @@ func startCommunicate(request *protocol.VMessRequest, dest v2net.Destination, ra
 	return nil
 }
 
-func handleRequest(conn *net.TCPConn, request *protocol.VMessRequest, firstPacket v2net.Packet, input <-chan []byte, finish *sync.Mutex) {
+// startUDPCommunicate tunnels a UDP destination through the VNext server,
+// treating each datagram from the ray's input channel as one chunk to send,
+// and each decrypted chunk read back as one datagram to push to the output
+// channel. The request is always chunked (see Start), so chunk boundaries
+// line up with datagram boundaries.
+func startUDPCommunicate(request *protocol.VMessRequest, dest v2net.Destination, receivers *ReceiverManager, timeSkew time.Duration, ray core.OutboundRay, firstPacket v2net.Packet) error {
+	conn, err := net.DialUDP(dest.Network(), nil, &net.UDPAddr{dest.Address().IP(), int(dest.Address().Port()), ""})
+	if err != nil {
+		log.Error("Failed to open udp (%s): %v", dest.String(), err)
+		receivers.ReportFailure(dest)
+		if ray != nil {
+			close(ray.OutboundOutput())
+		}
+		return err
+	}
+	log.Info("VMessOut: Tunneling UDP request for %s", request.Address.String())
+	defer conn.Close()
+
+	input := ray.OutboundInput()
+	output := ray.OutboundOutput()
+
+	encryptRequestWriter, err := v2io.NewAesEncryptWriter(request.RequestKey[:], request.RequestIV[:], conn)
+	if err != nil {
+		log.Error("VMessOut: Failed to create encrypt writer: %v", err)
+		close(output)
+		return err
+	}
+
+	clientSession := protocol.NewClientSession(user.HMACHash{}, timeSkew)
+	reqBuffer := alloc.SmallBuffer()
+	reqBuffer.Value, err = request.ToBytes(clientSession, user.GenerateRandomInt64InRange, reqBuffer.Value)
+	if err != nil {
+		log.Error("VMessOut: Failed to serialize VMess request: %v", err)
+		reqBuffer.Release()
+		close(output)
+		return err
+	}
+	_, err = conn.Write(reqBuffer.Value)
+	reqBuffer.Release()
+	if err != nil {
+		log.Error("VMessOut: Failed to write VMess request: %v", err)
+		close(output)
+		return err
+	}
+	chunkWriter := vmessio.NewChunkWriter(encryptRequestWriter)
+
+	responseKey := md5.Sum(request.RequestKey[:])
+	responseIV := md5.Sum(request.RequestIV[:])
+	decryptResponseReader, err := v2io.NewAesDecryptReader(responseKey[:], responseIV[:], conn)
+	if err != nil {
+		log.Error("VMessOut: Failed to create decrypt reader: %v", err)
+		close(output)
+		return err
+	}
+	response := protocol.VMessResponse{}
+	if _, err := decryptResponseReader.Read(response[:]); err != nil {
+		receivers.ReportFailure(dest)
+		close(output)
+		return err
+	}
+	if response[0] != protocol.ResponseHeaderToken(request.ResponseHeader[0], request.RequestKey[:]) {
+		log.Warning("VMessOut: unexepcted response header. The connection is probably hijacked.")
+		receivers.ReportFailure(dest)
+		close(output)
+		return nil
+	}
+	receivers.ReportSuccess(dest)
+	chunkReader := vmessio.NewChunkReader(decryptResponseReader)
+
+	var writeFinish, readFinish sync.Mutex
+	writeFinish.Lock()
+	readFinish.Lock()
+
+	go func() {
+		defer writeFinish.Unlock()
+		for {
+			// SetWriteDeadline only bounds the socket write below, not this
+			// channel receive, so an idle tunnel needs its own timer here;
+			// otherwise this goroutine (and the connection, via the deferred
+			// Close once both sides finish) would never unwind.
+			idleTimer := time.NewTimer(udpSessionTimeout)
+			select {
+			case payload, ok := <-input:
+				idleTimer.Stop()
+				if !ok {
+					return
+				}
+				conn.SetWriteDeadline(time.Now().Add(udpSessionTimeout))
+				if _, err := chunkWriter.Write(payload); err != nil {
+					log.Error("VMessOut: Failed to write UDP chunk: %v", err)
+					return
+				}
+			case <-idleTimer.C:
+				log.Info("VMessOut: UDP tunnel for %s idle for %v, closing", dest.String(), udpSessionTimeout)
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer readFinish.Unlock()
+		defer close(output)
+		datagramBuf := alloc.UDPBuffer()
+		defer datagramBuf.Release()
+		datagram := datagramBuf.Value[:cap(datagramBuf.Value)]
+		for {
+			conn.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+			n, err := chunkReader.Read(datagram)
+			if err != nil {
+				// Closing here makes the write goroutine's next chunk write
+				// fail; while it waits for input it still returns only on
+				// its next datagram or its own idle timer.
+				conn.Close()
+				return
+			}
+			// output is read by a different goroutine downstream and takes
+			// ownership of what's sent on it, so the datagram still needs a
+			// dedicated copy to hand off; only the scratch read buffer here
+			// is pooled.
+			payload := make([]byte, n)
+			copy(payload, datagram[:n])
+			output <- payload
+		}
+	}()
+
+	writeFinish.Lock()
+	readFinish.Lock()
+	return nil
+}
+
+func handleRequest(conn *net.TCPConn, request *protocol.VMessRequest, timeSkew time.Duration, firstPacket v2net.Packet, input <-chan []byte, finish *sync.Mutex) {
 	defer finish.Unlock()
 	encryptRequestWriter, err := v2io.NewAesEncryptWriter(request.RequestKey[:], request.RequestIV[:], conn)
 	if err != nil {
@@ -121,13 +258,22 @@ func handleRequest(conn *net.TCPConn, request *protocol.VMessRequest, firstPacke
 		return
 	}
 
-	buffer := make([]byte, 0, 2*1024)
-	buffer, err = request.ToBytes(user.NewTimeHash(user.HMACHash{}), user.GenerateRandomInt64InRange, buffer)
+	clientSession := protocol.NewClientSession(user.HMACHash{}, timeSkew)
+	reqBuffer := alloc.SmallBuffer()
+	defer reqBuffer.Release()
+	reqBuffer.Value, err = request.ToBytes(clientSession, user.GenerateRandomInt64InRange, reqBuffer.Value)
 	if err != nil {
 		log.Error("VMessOut: Failed to serialize VMess request: %v", err)
 		return
 	}
 
+	var payloadWriter io.Writer = encryptRequestWriter
+	var chunkWriter *vmessio.ChunkWriter
+	if request.Option.Has(protocol.OptionChunkStream) {
+		chunkWriter = vmessio.NewChunkWriter(encryptRequestWriter)
+		payloadWriter = chunkWriter
+	}
+
 	// Send first packet of payload together with request, in favor of small requests.
 	firstChunk := firstPacket.Chunk()
 	moreChunks := firstPacket.MoreChunks()
@@ -137,23 +283,43 @@ func handleRequest(conn *net.TCPConn, request *protocol.VMessRequest, firstPacke
 	}
 
 	if firstChunk != nil {
-		encryptRequestWriter.Crypt(firstChunk)
-		buffer = append(buffer, firstChunk...)
+		if chunkWriter == nil {
+			encryptRequestWriter.Crypt(firstChunk)
+			reqBuffer.Append(firstChunk)
 
-		_, err = conn.Write(buffer)
-		if err != nil {
-			log.Error("VMessOut: Failed to write VMess request: %v", err)
-			return
+			_, err = conn.Write(reqBuffer.Value)
+			if err != nil {
+				log.Error("VMessOut: Failed to write VMess request: %v", err)
+				return
+			}
+		} else {
+			_, err = conn.Write(reqBuffer.Value)
+			if err != nil {
+				log.Error("VMessOut: Failed to write VMess request: %v", err)
+				return
+			}
+			_, err = chunkWriter.Write(firstChunk)
+			if err != nil {
+				log.Error("VMessOut: Failed to write VMess request: %v", err)
+				return
+			}
 		}
 	}
 
 	if moreChunks {
-		v2net.ChanToWriter(encryptRequestWriter, input)
+		v2net.ChanToWriter(payloadWriter, input)
+	}
+
+	// Close sends the reserved terminator chunk that marks a clean end of
+	// stream; a zero-length chunk is ordinary data and does not end it.
+	// startCommunicate still calls CloseWrite after this returns.
+	if chunkWriter != nil {
+		chunkWriter.Close()
 	}
 	return
 }
 
-func handleResponse(conn *net.TCPConn, request *protocol.VMessRequest, output chan<- []byte, finish *sync.Mutex) {
+func handleResponse(conn *net.TCPConn, request *protocol.VMessRequest, dest v2net.Destination, receivers *ReceiverManager, output chan<- []byte, finish *sync.Mutex) {
 	defer finish.Unlock()
 	defer close(output)
 	responseKey := md5.Sum(request.RequestKey[:])
@@ -169,20 +335,30 @@ func handleResponse(conn *net.TCPConn, request *protocol.VMessRequest, output ch
 	_, err = decryptResponseReader.Read(response[:])
 	if err != nil {
 		//log.Error("VMessOut: Failed to read VMess response (%d bytes): %v", nBytes, err)
+		receivers.ReportFailure(dest)
 		return
 	}
-	if !bytes.Equal(response[:], request.ResponseHeader[:]) {
+	if response[0] != protocol.ResponseHeaderToken(request.ResponseHeader[0], request.RequestKey[:]) {
 		log.Warning("VMessOut: unexepcted response header. The connection is probably hijacked.")
+		receivers.ReportFailure(dest)
 		return
 	}
+	receivers.ReportSuccess(dest)
+
+	var payloadReader io.Reader = decryptResponseReader
+	if request.Option.Has(protocol.OptionChunkStream) {
+		payloadReader = vmessio.NewChunkReader(decryptResponseReader)
+	}
 
-	v2net.ReaderToChan(output, decryptResponseReader)
+	v2net.ReaderToChan(output, payloadReader)
 	return
 }
 
 type VMessOutboundHandlerFactory struct {
-	servers    []VNextServer
-	udpServers []VNextServer
+	receivers         *ReceiverManager
+	receiversUDP      *ReceiverManager
+	enableChunkStream bool
+	timeSkew          time.Duration
 }
 
 func (factory *VMessOutboundHandlerFactory) Initialize(rawConfig []byte) error {
@@ -201,13 +377,19 @@ func (factory *VMessOutboundHandlerFactory) Initialize(rawConfig []byte) error {
 			udpServers = append(udpServers, server.ToVNextServer())
 		}
 	}
-	factory.servers = servers
-	factory.udpServers = udpServers
+	factory.receivers = NewReceiverManager(servers, config.ReceiverFailureThreshold, config.ReceiverCooldown)
+	factory.receiversUDP = NewReceiverManager(udpServers, config.ReceiverFailureThreshold, config.ReceiverCooldown)
+	// TCP connections are unframed by default; operators can trade a few
+	// bytes per chunk for integrity checking and early truncation detection.
+	factory.enableChunkStream = config.EnableChunkStream
+	// config.TimeSkew <= 0 leaves ClientSession to fall back to
+	// protocol.DefaultTimeSkew.
+	factory.timeSkew = config.TimeSkew
 	return nil
 }
 
 func (factory *VMessOutboundHandlerFactory) Create(vp *core.Point, firstPacket v2net.Packet) (core.OutboundConnectionHandler, error) {
-	return NewVMessOutboundHandler(vp, factory.servers, factory.udpServers, firstPacket), nil
+	return NewVMessOutboundHandler(vp, factory.receivers, factory.receiversUDP, factory.enableChunkStream, factory.timeSkew, firstPacket), nil
 }
 
 func init() {